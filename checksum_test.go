@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestChecksumDetectsCorruption(t *testing.T) {
+	name := "mergefs-checksum-0"
+	os.Remove(name)
+	defer os.Remove(name)
+
+	sf, err := OpenSegFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("checked payload")
+	if _, err := sf.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte in the payload, past the header, without touching its
+	// checksum.
+	f, err := os.OpenFile(name, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{'X'}, int64(frameHeaderSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sf, err = OpenSegFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+
+	if _, err := sf.ReadAt(0, int64(len(content))); err == nil {
+		t.Error("expect a corrupt frame error, got nil")
+	} else if _, ok := err.(*CorruptFrameError); !ok {
+		t.Errorf("expect *CorruptFrameError, got %T: %v", err, err)
+	}
+
+	corrupt, err := sf.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 1 || corrupt[0] != 0 {
+		t.Errorf("expect corrupt offset [0], got %v", corrupt)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	name := "mergefs-compact-0"
+	os.Remove(name)
+	defer os.Remove(name)
+
+	sf, err := OpenSegFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+
+	// Overwrite the same range repeatedly; only the last write should
+	// survive compaction.
+	for i := 0; i < 5; i++ {
+		if _, err := sf.WriteAt([]byte("aaaaaaaaaa"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	final := []byte("final-data")
+	if _, err := sf.WriteAt(final, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	before := sf.Stats()
+	if before.FrameCount != 6 {
+		t.Errorf("expect 6 frames before compaction, got %d", before.FrameCount)
+	}
+
+	stats, err := sf.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FrameCount != 1 {
+		t.Errorf("expect 1 live frame after compaction, got %d", stats.FrameCount)
+	}
+	if stats.LiveBytes != stats.TotalBytes {
+		t.Errorf("expect all bytes live after compaction, got %d/%d", stats.LiveBytes, stats.TotalBytes)
+	}
+
+	frames, err := sf.ReadAt(0, int64(len(final)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || string(frames[0].data) != string(final) {
+		t.Errorf("expect %q after compaction, got %v", final, frames)
+	}
+}
+
+// TestAutoCompactSmallPayloads guards against a unit mismatch between
+// Stats.LiveBytes (payload only) and Stats.TotalBytes (which used to
+// include frame header overhead): for payloads smaller than
+// frameHeaderSize, that mismatch made WithAutoCompact's trigger
+// condition true on every write past the threshold, even with nothing
+// to reclaim, turning each WriteAt into an O(n) Compact.
+func TestAutoCompactSmallPayloads(t *testing.T) {
+	name := "mergefs-compact-small-0"
+	os.Remove(name)
+	defer os.Remove(name)
+
+	sf, err := OpenSegFile(name, WithAutoCompact(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+
+	const writes = 2000
+	start := time.Now()
+	for i := 0; i < writes; i++ {
+		if _, err := sf.WriteAt([]byte{byte(i)}, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expect %d non-overlapping 1-byte writes to finish quickly, took %s", writes, elapsed)
+	}
+
+	stats := sf.Stats()
+	if stats.FrameCount != writes {
+		t.Errorf("expect %d frames, got %d", writes, stats.FrameCount)
+	}
+	if stats.LiveBytes != stats.TotalBytes {
+		t.Errorf("expect every byte live since nothing was overwritten, got %d/%d", stats.LiveBytes, stats.TotalBytes)
+	}
+}
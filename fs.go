@@ -0,0 +1,276 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FS adapts a directory of merged segment files to io/fs.FS and
+// http.FileSystem, so merged files can be plugged into http.FileServer,
+// text/template, or any other stdlib code that consumes those
+// interfaces. Logical file names are discovered by grouping sibling
+// "name-0", "name-1", ... segments and stripping the numeric suffix.
+type FS struct {
+	dir string
+	n   int
+}
+
+// Option configures an FS.
+type Option func(*FS)
+
+// WithReplicas sets the number of segment replicas n each logical file
+// is split across. The default is numFiles.
+func WithReplicas(n int) Option {
+	return func(fsys *FS) {
+		if n > 0 {
+			fsys.n = n
+		}
+	}
+}
+
+// NewFS returns an fs.FS rooted at dir.
+func NewFS(dir string, opts ...Option) fs.FS {
+	fsys := &FS{dir: dir, n: numFiles}
+	for _, opt := range opts {
+		opt(fsys)
+	}
+	return fsys
+}
+
+func segName(dir, name string, i int) string {
+	return path.Join(dir, name) + "-" + strconv.Itoa(i)
+}
+
+// logicalName strips the "-N" segment suffix from a directory entry
+// name, returning ok=false if the entry isn't a segment file.
+func logicalName(entry string) (name string, ok bool) {
+	i := strings.LastIndexByte(entry, '-')
+	if i < 0 || i == len(entry)-1 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(entry[i+1:]); err != nil {
+		return "", false
+	}
+	return entry[:i], true
+}
+
+func (fsys *FS) listDir(name string) ([]string, error) {
+	entries, err := os.ReadDir(path.Join(fsys.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			if !seen[e.Name()] {
+				seen[e.Name()] = true
+				names = append(names, e.Name())
+			}
+			continue
+		}
+		n, ok := logicalName(e.Name())
+		if !ok || seen[n] {
+			continue
+		}
+		seen[n] = true
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Open implements fs.FS.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	full := path.Join(fsys.dir, name)
+	if fi, err := os.Stat(full); err == nil && fi.IsDir() {
+		names, err := fsys.listDir(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dirFile{name: path.Base(name), names: names}, nil
+	}
+	// OpenFileN creates any segment missing an on-disk file, so a
+	// logical name with no segments at all must be rejected here first
+	// - otherwise Open would silently create empty segments for every
+	// unmatched name instead of reporting fs.ErrNotExist.
+	if _, err := os.Stat(segName(fsys.dir, name, 0)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f, err := OpenFileN(full, fsys.n)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{file: f, name: path.Base(name), size: f.Size()}, nil
+}
+
+// httpOpen implements http.FileSystem's Open for httpFS, mapping the
+// rooted, slash-separated http path onto an fs.FS name.
+func (fsys *FS) httpOpen(name string) (http.File, error) {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "."
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.(http.File), nil
+}
+
+// HTTPFileSystem adapts dir to http.FileSystem for use with
+// http.FileServer.
+func HTTPFileSystem(dir string, opts ...Option) http.FileSystem {
+	return &httpFS{FS: NewFS(dir, opts...).(*FS)}
+}
+
+type httpFS struct {
+	*FS
+}
+
+func (h *httpFS) Open(name string) (http.File, error) {
+	return h.httpOpen(name)
+}
+
+// fsFile wraps a *File with the cursor and metadata needed to satisfy
+// fs.File and http.File.
+type fsFile struct {
+	file *File
+	name string
+	off  int64
+	size int64
+}
+
+func (sf *fsFile) Stat() (fs.FileInfo, error) {
+	return fileInfo{name: sf.name, size: sf.size}, nil
+}
+
+func (sf *fsFile) Read(b []byte) (int, error) {
+	n, err := sf.file.ReadAt(b, sf.off)
+	sf.off += int64(n)
+	if err == nil && n == 0 && len(b) > 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (sf *fsFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		sf.off = offset
+	case io.SeekCurrent:
+		sf.off += offset
+	case io.SeekEnd:
+		sf.off = sf.size + offset
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: sf.name, Err: fs.ErrInvalid}
+	}
+	if sf.off < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: sf.name, Err: fs.ErrInvalid}
+	}
+	return sf.off, nil
+}
+
+func (sf *fsFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: sf.name, Err: fs.ErrInvalid}
+}
+
+func (sf *fsFile) Close() error {
+	return sf.file.Close()
+}
+
+// dirFile implements fs.ReadDirFile and http.File for a directory of
+// logical merged files.
+type dirFile struct {
+	name  string
+	names []string
+	off   int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return fileInfo{name: d.name, isDir: true}, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := d.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, fi := range infos {
+		entries[i] = fs.FileInfoToDirEntry(fi)
+	}
+	return entries, nil
+}
+
+func (d *dirFile) Readdir(count int) ([]fs.FileInfo, error) {
+	var names []string
+	if count <= 0 {
+		names = d.names[d.off:]
+		d.off = len(d.names)
+	} else {
+		end := d.off + count
+		if end > len(d.names) {
+			end = len(d.names)
+		}
+		names = d.names[d.off:end]
+		d.off = end
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+	}
+	infos := make([]fs.FileInfo, len(names))
+	for i, n := range names {
+		infos[i] = fileInfo{name: n}
+	}
+	return infos, nil
+}
+
+// fileInfo is a minimal fs.FileInfo for merged files and directories,
+// which have no persisted mode or modification time.
+type fileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.isDir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
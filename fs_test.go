@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFS(t *testing.T) {
+	dir := "testfs"
+	name := "foo"
+	os.MkdirAll(dir, os.ModePerm)
+	defer os.RemoveAll(dir)
+	content := []byte("hello mergefs")
+	{
+		f, err := OpenFile(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(content, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := NewFS(dir)
+	f, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Errorf("expect size %d, got %d", len(content), fi.Size())
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(content) {
+		t.Errorf("expect %q, got %q", content, b)
+	}
+	if seeker, ok := f.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b2, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b2) != string(content) {
+			t.Errorf("expect %q, got %q", content, b2)
+		}
+	}
+	root, err := fsys.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	entries, err := root.(fs.ReadDirFile).ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		t.Errorf("expect [%s], got %v", name, entries)
+	}
+}
+
+// TestFSOpenMissing guards against Open silently creating empty
+// segment files for a logical name that doesn't exist, instead of
+// reporting fs.ErrNotExist - both through the fs.FS interface directly
+// and through http.FileServer, the adapter's headline use case.
+func TestFSOpenMissing(t *testing.T) {
+	dir := "testfs-missing"
+	os.MkdirAll(dir, os.ModePerm)
+	defer os.RemoveAll(dir)
+
+	fsys := NewFS(dir)
+	if _, err := fsys.Open("does-not-exist"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expect fs.ErrNotExist, got %v", err)
+	}
+	if _, err := os.Stat(dir + "/does-not-exist-0"); !os.IsNotExist(err) {
+		t.Errorf("expect Open of a missing name not to create segment files, got %v", err)
+	}
+
+	ts := httptest.NewServer(http.FileServer(HTTPFileSystem(dir)))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/does-not-exist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expect 404, got %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(dir + "/does-not-exist-0"); !os.IsNotExist(err) {
+		t.Errorf("expect http.FileServer request for a missing name not to create segment files, got %v", err)
+	}
+}
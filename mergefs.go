@@ -5,40 +5,113 @@
 package mergefs
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math/rand"
 	"os"
 	"sort"
-	"unsafe"
+	"sync"
+	"sync/atomic"
 )
 
 const (
 	numFiles = 2
 )
 
-const frameHeaderSize = int(unsafe.Sizeof(frameHeader{}))
+// frameMagic marks a version 2 or later frame header, distinguishing
+// it from the legacy, checksum-less header written before checksums
+// were introduced.
+const frameMagic uint32 = 0x6d666632 // "mgf2"
 
+// frameVersion is the current on-disk frame header version. Version 3
+// added the seq field Repair uses to tell two replicas' versions of
+// an overwritten frame apart; a version 2 header (checksum, no seq)
+// is still read correctly, with seq defaulting to 0.
+const frameVersion uint8 = 3
+
+// frameHeaderSizeV2 is the size, in bytes, of a version 2 frame
+// header: a 4-byte magic, a 1-byte version, the 8-byte offset and
+// size, and a 4-byte CRC32C checksum of the payload.
+const frameHeaderSizeV2 = 4 + 1 + 8 + 8 + 4
+
+// frameHeaderSize is the size of the current, version 3 frame header:
+// a version 2 header plus an 8-byte write sequence number.
+const frameHeaderSize = frameHeaderSizeV2 + 8
+
+// legacyFrameHeaderSize is the size of the header written before
+// version 2, holding only the offset and size with no checksum.
+const legacyFrameHeaderSize = 8 + 8
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// frameHeader is the on-disk header preceding a frame's payload.
 type frameHeader struct {
-	off  uint64
-	size uint64
+	off      uint64
+	size     uint64
+	checksum uint32
+	// seq is the write's logical sequence number, assigned by File so
+	// Repair can tell which of two replicas holds the newer version
+	// of an overwritten (off, size) range. It is 0 for a frame written
+	// directly through a SegFile, same as a legacy frame predating it.
+	seq uint64
+	// legacy is set when the header was decoded from the pre-checksum
+	// format; its checksum is unknown and Verify skips it.
+	legacy bool
+}
+
+func newFrameHeader(off uint64, payload []byte, seq uint64) frameHeader {
+	return frameHeader{off: off, size: uint64(len(payload)), checksum: crc32.Checksum(payload, crc32cTable), seq: seq}
 }
 
 func (h *frameHeader) marshal() []byte {
-	var b []byte
-	hdr := (*struct {
-		data uintptr
-		len  int
-		cap  int
-	})(unsafe.Pointer(&b))
-	hdr.data = uintptr(unsafe.Pointer(h))
-	hdr.len = frameHeaderSize
-	hdr.cap = frameHeaderSize
+	b := make([]byte, frameHeaderSize)
+	binary.LittleEndian.PutUint32(b[0:4], frameMagic)
+	b[4] = frameVersion
+	binary.LittleEndian.PutUint64(b[5:13], h.off)
+	binary.LittleEndian.PutUint64(b[13:21], h.size)
+	binary.LittleEndian.PutUint32(b[21:25], h.checksum)
+	binary.LittleEndian.PutUint64(b[25:33], h.seq)
 	return b
 }
 
-func (h *frameHeader) unmarshal(b []byte) {
-	*h = *(*frameHeader)(unsafe.Pointer(&b[0]))
+// unmarshalFrameHeader decodes a frame header from b, which holds the
+// bytes read from disk at the frame's starting position; b may be
+// shorter than frameHeaderSize if the read hit EOF. It reports the
+// number of bytes the header actually occupied, so the caller can
+// locate the payload that follows a version 3, version 2, or legacy
+// header, and ok=false if b held an incomplete header, i.e. a torn
+// write.
+func unmarshalFrameHeader(b []byte) (h frameHeader, size int, ok bool) {
+	if len(b) >= 5 && binary.LittleEndian.Uint32(b[0:4]) == frameMagic {
+		switch b[4] {
+		case frameVersion:
+			if len(b) < frameHeaderSize {
+				return frameHeader{}, 0, false
+			}
+			h.off = binary.LittleEndian.Uint64(b[5:13])
+			h.size = binary.LittleEndian.Uint64(b[13:21])
+			h.checksum = binary.LittleEndian.Uint32(b[21:25])
+			h.seq = binary.LittleEndian.Uint64(b[25:33])
+			return h, frameHeaderSize, true
+		case 2:
+			if len(b) < frameHeaderSizeV2 {
+				return frameHeader{}, 0, false
+			}
+			h.off = binary.LittleEndian.Uint64(b[5:13])
+			h.size = binary.LittleEndian.Uint64(b[13:21])
+			h.checksum = binary.LittleEndian.Uint32(b[21:25])
+			return h, frameHeaderSizeV2, true
+		}
+	}
+	if len(b) >= legacyFrameHeaderSize {
+		h.off = binary.LittleEndian.Uint64(b[0:8])
+		h.size = binary.LittleEndian.Uint64(b[8:16])
+		h.legacy = true
+		return h, legacyFrameHeaderSize, true
+	}
+	return frameHeader{}, 0, false
 }
 
 type frame struct {
@@ -52,6 +125,18 @@ type Frame struct {
 	data []byte
 }
 
+// CorruptFrameError reports a frame whose checksum didn't match its
+// payload, most likely due to a torn write or bit rot. ReadAt skips
+// the frame so a healthy replica can fill the gap.
+type CorruptFrameError struct {
+	Name   string
+	Offset int64
+}
+
+func (e *CorruptFrameError) Error() string {
+	return fmt.Sprintf("mergefs: corrupt frame at offset %d in %s", e.Offset, e.Name)
+}
+
 func mergeFrames(a []Frame, b []Frame) []Frame {
 	if len(a) == 0 {
 		return b
@@ -86,7 +171,14 @@ func mergeFrames(a []Frame, b []Frame) []Frame {
 // Remove removes the named file or (empty) directory.
 // If there is an error, it will be of type *PathError.
 func Remove(name string) error {
-	for i := 0; i < numFiles; i++ {
+	return RemoveN(name, numFiles)
+}
+
+// RemoveN removes the n segment replicas of the named file or (empty)
+// directory.
+// If there is an error, it will be of type *PathError.
+func RemoveN(name string, n int) error {
+	for i := 0; i < n; i++ {
 		err := os.Remove(fmt.Sprintf("%s-%d", name, i))
 		if err != nil {
 			return err
@@ -95,17 +187,59 @@ func Remove(name string) error {
 	return nil
 }
 
-// File represents a merged file.
+// Policy controls how a File with more than one replica handles writes
+// and reads. The zero Policy preserves the original behavior: WriteAt
+// writes to a single random replica and ReadAt merges frames gathered
+// from every replica.
+type Policy struct {
+	// W is the number of replicas a WriteAt must succeed on before it
+	// returns. Replicas beyond W keep writing in the background and are
+	// reconciled by Repair. A value <= 0 means a single replica, chosen
+	// at random, matching the zero Policy.
+	W int
+	// R is the number of replicas ReadAt gathers frames from before
+	// merging and returning. A value <= 0 or >= the replica count means
+	// every replica is read, matching the zero Policy.
+	R int
+	// ReadRepair runs Repair in the background after every ReadAt whose
+	// read set, as restricted by R, leaves out at least one replica.
+	// ReadAt does not compare the replicas it reads or check them for
+	// corrupt frames, so when every replica is read it never runs Repair.
+	ReadRepair bool
+}
+
+// File represents a merged file. It satisfies io.ReaderAt, io.WriterAt,
+// and io.Closer.
 type File struct {
-	files []SegFile
+	// seq is the next write sequence number, assigned atomically so
+	// Repair can tell which replica holds the newer version of an
+	// overwritten frame; it must stay first for 64-bit alignment on
+	// 32-bit platforms.
+	seq    uint64
+	files  []SegFile
+	policy Policy
 }
 
+var (
+	_ io.ReaderAt = (*File)(nil)
+	_ io.WriterAt = (*File)(nil)
+	_ io.Closer   = (*File)(nil)
+)
+
 // OpenFile opens the named file for reading. If successful, methods on
 // the returned file can be used for reading; the associated file
 // descriptor has mode O_RDONLY.
 // If there is an error, it will be of type *PathError.
 func OpenFile(name string) (*File, error) {
-	var files = make([]SegFile, numFiles)
+	return OpenFileN(name, numFiles)
+}
+
+// OpenFileN opens the named file split across n segment replicas,
+// "name-0" through "name-(n-1)", for reading and writing, creating any
+// segment that does not exist yet.
+// If there is an error, it will be of type *PathError.
+func OpenFileN(name string, n int) (*File, error) {
+	var files = make([]SegFile, n)
 	for i := 0; i < len(files); i++ {
 		file, err := OpenSegFile(fmt.Sprintf("%s-%d", name, i))
 		if err != nil {
@@ -124,6 +258,13 @@ func Open(files ...SegFile) (*File, error) {
 	return &File{files: files}, nil
 }
 
+// WithPolicy sets the write/read policy used by WriteAt, ReadAt, and
+// Repair, and returns f for chaining.
+func (f *File) WithPolicy(policy Policy) *File {
+	f.policy = policy
+	return f
+}
+
 func (f *File) file() SegFile {
 	return f.files[rand.Intn(len(f.files))]
 }
@@ -132,23 +273,127 @@ func (f *File) file() SegFile {
 // at offset off. It returns the number of bytes written from p (0 <= n <= len(p))
 // and any error encountered that caused the write to stop early.
 // WriteAt must return a non-nil error if it returns n < len(p).
+//
+// With the zero Policy, or a single replica, it writes to one randomly
+// chosen replica. Otherwise it dispatches the write to every replica
+// concurrently and returns once Policy.W of them succeed; any
+// stragglers keep writing in the background and are reconciled by a
+// subsequent Repair if they failed.
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
-	n, err = f.file().WriteAt(b, off)
-	if err != nil {
-		return
+	seq := atomic.AddUint64(&f.seq, 1)
+	if f.policy.W <= 0 || len(f.files) == 1 {
+		return writeAtSeq(f.file(), b, off, seq)
 	}
-	return
+	w := f.policy.W
+	if w > len(f.files) {
+		w = len(f.files)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	results := make(chan result, len(f.files))
+	for _, sf := range f.files {
+		sf := sf
+		go func() {
+			nn, werr := writeAtSeq(sf, b, off, seq)
+			results <- result{nn, werr}
+		}()
+	}
+	var ok, seen int
+	for seen < len(f.files) && ok < w {
+		r := <-results
+		seen++
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+			}
+			continue
+		}
+		ok++
+		if r.n > n {
+			n = r.n
+		}
+	}
+	if seen < len(f.files) {
+		remaining := len(f.files) - seen
+		go func() {
+			failed := false
+			for i := 0; i < remaining; i++ {
+				if r := <-results; r.err != nil {
+					failed = true
+				}
+			}
+			if failed {
+				f.Repair()
+			}
+		}()
+	}
+	if ok < w {
+		if err == nil {
+			err = fmt.Errorf("mergefs: write succeeded on %d/%d replicas, want %d", ok, len(f.files), w)
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+// SeqWriter is implemented by a SegFile backend that can stamp a write
+// with a logical sequence number, so Repair can tell which of two
+// replicas holds the newer version of an overwritten (offset, size)
+// range. A SegFile without it is written to through plain WriteAt and
+// treated like a legacy, sequence-less frame: always superseded by
+// any sequenced write Repair has seen for the same range.
+type SeqWriter interface {
+	WriteAtSeq(b []byte, off int64, seq uint64) (n int, err error)
+}
+
+// writeAtSeq stamps b with seq when sf is a SeqWriter, falling back to
+// a plain WriteAt otherwise.
+func writeAtSeq(sf SegFile, b []byte, off int64, seq uint64) (int, error) {
+	if sw, ok := sf.(SeqWriter); ok {
+		return sw.WriteAtSeq(b, off, seq)
+	}
+	return sf.WriteAt(b, off)
+}
+
+// readSet returns the indexes of the replicas ReadAt should gather
+// frames from.
+func (f *File) readSet() []int {
+	r := f.policy.R
+	if r <= 0 || r >= len(f.files) {
+		idx := make([]int, len(f.files))
+		for i := range idx {
+			idx[i] = i
+		}
+		return idx
+	}
+	idx := rand.Perm(len(f.files))[:r]
+	sort.Ints(idx)
+	return idx
 }
 
 // ReadAt reads len(p) bytes into p starting at offset off in the
 // underlying input source. It returns the number of bytes
 // read (0 <= n <= len(p)) and any error encountered.
+//
+// With the zero Policy it gathers frames from every replica, matching
+// the original behavior. Policy.R restricts this to a quorum of R
+// replicas, and Policy.ReadRepair then runs Repair in the background
+// to heal the replicas left out of the read.
 func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
+	idx := f.readSet()
 	var frames []Frame
-	for i := 0; i < len(f.files); i++ {
-		ss, err := f.files[i].ReadAt(off, int64(len(b)))
-		if err != nil && err != io.EOF {
-			return 0, err
+	lagging := len(idx) < len(f.files)
+	for _, i := range idx {
+		ss, rerr := f.files[i].ReadAt(off, int64(len(b)))
+		if rerr != nil && rerr != io.EOF {
+			if _, corrupt := rerr.(*CorruptFrameError); !corrupt {
+				return 0, rerr
+			}
+			// A corrupt frame was skipped; fall through and merge
+			// whatever healthy frames this and the other replicas
+			// have, so an intact replica can fill the gap.
 		}
 		frames = mergeFrames(frames, ss)
 	}
@@ -165,9 +410,94 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 		off += int64(num)
 		n += num
 	}
+	if f.policy.ReadRepair && lagging {
+		go f.Repair()
+	}
 	return n, err
 }
 
+// Repair walks frame headers across every replica and, for each
+// distinct (offset, size) range, copies whichever replica holds the
+// highest write sequence number to every replica lagging behind it -
+// healing both a straggler missing the frame entirely and one still
+// holding a stale version of a range another replica has since
+// overwritten.
+func (f *File) Repair() error {
+	size := f.Size()
+	if size == 0 {
+		return nil
+	}
+	perFile := make([][]Frame, len(f.files))
+	for i := range f.files {
+		frames, err := f.files[i].ReadAt(0, size)
+		if err != nil && err != io.EOF {
+			if _, corrupt := err.(*CorruptFrameError); !corrupt {
+				return err
+			}
+		}
+		perFile[i] = frames
+	}
+	type key struct {
+		off, size uint64
+	}
+	newest := make(map[key]Frame)
+	var order []key
+	for _, frames := range perFile {
+		for _, fr := range frames {
+			k := key{fr.off, fr.size}
+			cur, ok := newest[k]
+			if !ok {
+				order = append(order, k)
+				newest[k] = fr
+			} else if fr.seq > cur.seq {
+				newest[k] = fr
+			}
+		}
+	}
+	for i := range f.files {
+		have := make(map[key]uint64, len(perFile[i]))
+		for _, fr := range perFile[i] {
+			have[key{fr.off, fr.size}] = fr.seq
+		}
+		for _, k := range order {
+			fr := newest[k]
+			if seq, ok := have[k]; ok && seq >= fr.seq {
+				continue
+			}
+			if _, err := writeAtSeq(f.files[i], fr.data, int64(fr.off), fr.seq); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CorruptFrame identifies a frame that failed its checksum check
+// during Verify.
+type CorruptFrame struct {
+	Replica int
+	Offset  int64
+}
+
+// Verify scans every replica's recorded frames, validating each
+// payload against its stored checksum, and returns the offsets of any
+// that are corrupt. It is meant to be run periodically in the
+// background; it does not modify the file, so a corrupt offset should
+// be healed by rewriting that range from a healthy replica.
+func (f *File) Verify() ([]CorruptFrame, error) {
+	var corrupt []CorruptFrame
+	for i := range f.files {
+		offsets, err := f.files[i].Verify()
+		if err != nil {
+			return corrupt, err
+		}
+		for _, off := range offsets {
+			corrupt = append(corrupt, CorruptFrame{Replica: i, Offset: off})
+		}
+	}
+	return corrupt, nil
+}
+
 // Close closes the File, rendering it unusable for I/O.
 // On files that support SetDeadline, any pending I/O operations will
 // be canceled and return immediately with an error.
@@ -182,6 +512,29 @@ func (f *File) Close() error {
 	return nil
 }
 
+// Sync commits the current contents of every underlying replica to
+// stable storage.
+func (f *File) Sync() error {
+	for i := 0; i < len(f.files); i++ {
+		if err := f.files[i].Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the logical length of the merged file, taken as the
+// largest size reported by any underlying segment.
+func (f *File) Size() int64 {
+	var size int64
+	for i := 0; i < len(f.files); i++ {
+		if n := f.files[i].Size(); n > size {
+			size = n
+		}
+	}
+	return size
+}
+
 // SegFile represents a segmented file.
 type SegFile interface {
 	// WriteAt writes len(p) bytes from p to the underlying data stream
@@ -197,48 +550,214 @@ type SegFile interface {
 	// be canceled and return immediately with an error.
 	// Close will return an error if it has already been called.
 	Close() error
+	// Size returns the logical length of the segment, computed from the
+	// highest offset covered by any recorded frame.
+	Size() int64
+	// Verify validates every recorded frame's payload against its
+	// stored checksum and returns the offsets of any that are corrupt.
+	// Frames written before checksums were introduced are assumed
+	// healthy.
+	Verify() ([]int64, error)
+	// Stats reports the segment's live vs. total bytes, useful for
+	// deciding when to Compact.
+	Stats() Stats
+	// Compact rewrites the segment into a new file holding only the
+	// live byte ranges - the parts of each frame not shadowed by a
+	// later overwrite - and atomically renames it into place. It
+	// returns the segment's stats after compaction.
+	Compact() (Stats, error)
+	// Sync commits the segment's current contents to stable storage.
+	Sync() error
+}
+
+// Stats reports a segment's live vs. total bytes. Both counts are
+// payload bytes with frame header overhead excluded, so the two are
+// directly comparable: LiveBytes == TotalBytes exactly when nothing is
+// left to reclaim.
+type Stats struct {
+	// LiveBytes is the payload bytes still reachable, i.e. not
+	// shadowed by a later overwrite of the same range.
+	LiveBytes int64
+	// TotalBytes is the payload bytes recorded across every frame,
+	// live or not.
+	TotalBytes int64
+	FrameCount int
+}
+
+// Storage is the block storage backend a segFile writes its frames
+// to. *os.File satisfies it directly; other backends such as an
+// in-memory buffer, an mmap-backed region, or a remote HTTP range
+// reader can be used through OpenStorage.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// compactableStorage is implemented by storage backends that can be
+// atomically replaced by name, such as a local file. Backends without
+// a stable name, like an in-memory buffer or a remote read-only
+// reader, don't support Compact.
+type compactableStorage interface {
+	Storage
+	Name() string
 }
 
 type segFile struct {
-	file   *os.File
-	off    int64
-	frames []frame
+	// mu guards every field below it. A File fans WriteAt out to its
+	// replicas concurrently and runs Repair/ReadRepair in the
+	// background, so a segFile is shared across goroutines even though
+	// the on-disk frame index it maintains is not otherwise safe for
+	// concurrent access.
+	mu      sync.Mutex
+	storage Storage
+	off     int64
+	frames  []frame
+	// autoCompact is the configured WithAutoCompact threshold; 0 disables it.
+	autoCompact int64
+	// nextCompactCheck is the f.off at which WriteAt should next call
+	// Stats to decide whether to Compact.
+	nextCompactCheck int64
+	// checkInterval is the current spacing, in bytes of growth,
+	// between checks. It doubles every time a check finds nothing
+	// worth compacting and resets to autoCompact right after a
+	// Compact, so a segment that never accumulates garbage is
+	// rechecked exponentially less often instead of on every write.
+	checkInterval int64
+}
+
+// SegFileOption configures a segFile opened via OpenSegFile.
+type SegFileOption func(*segFile)
+
+// WithAutoCompact enables automatic compaction: once the segment's
+// on-disk size reaches threshold, a WriteAt checks Stats and runs
+// Compact if fewer than half of the recorded payload bytes are live.
+// The check itself walks every recorded frame, so its interval backs
+// off exponentially while nothing is worth compacting, rather than
+// recomputing Stats from scratch on every single write.
+func WithAutoCompact(threshold int64) SegFileOption {
+	return func(f *segFile) {
+		f.autoCompact = threshold
+		f.nextCompactCheck = threshold
+		f.checkInterval = threshold
+	}
+}
+
+// liveRange is a sub-range of a frame that is still live, i.e. not
+// shadowed by a later, overlapping write.
+type liveRange struct {
+	off, size uint64
+	frameIdx  int
+}
+
+// liveRanges walks frames newest-to-oldest, marking the byte ranges
+// each one covers, and returns the sub-ranges of each frame that
+// aren't already covered by a more recent frame.
+func liveRanges(frames []frame) []liveRange {
+	type span struct{ lo, hi uint64 }
+	var covered []span
+	var live []liveRange
+	for i := len(frames) - 1; i >= 0; i-- {
+		s := frames[i]
+		segs := []span{{s.off, s.off + s.size}}
+		for _, c := range covered {
+			var next []span
+			for _, sp := range segs {
+				if c.hi <= sp.lo || c.lo >= sp.hi {
+					next = append(next, sp)
+					continue
+				}
+				if c.lo > sp.lo {
+					next = append(next, span{sp.lo, c.lo})
+				}
+				if c.hi < sp.hi {
+					next = append(next, span{c.hi, sp.hi})
+				}
+			}
+			segs = next
+		}
+		for _, sp := range segs {
+			live = append(live, liveRange{off: sp.lo, size: sp.hi - sp.lo, frameIdx: i})
+		}
+		covered = append(covered, span{s.off, s.off + s.size})
+	}
+	return live
 }
 
 // OpenSegFile opens the segmented file for reading. If successful, methods on
 // the returned file can be used for reading; the associated file
 // descriptor has mode O_RDONLY.
 // If there is an error, it will be of type *PathError.
-func OpenSegFile(name string) (SegFile, error) {
+//
+// Scanning stops at the first torn write: a frame header that wasn't
+// fully written, or one whose declared payload runs past the end of
+// the file. Anything after that point is discarded, since a healthy
+// replica is expected to fill it back in via Repair.
+func OpenSegFile(name string, opts ...SegFileOption) (SegFile, error) {
 	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
-	f := &segFile{file: file}
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f := &segFile{storage: file}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if err := f.scan(fi.Size()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenStorage opens a segment backed by an arbitrary Storage
+// implementation - an in-memory buffer, an mmap-backed region, or a
+// remote HTTP range reader - instead of a local file. size is the
+// storage's current length, used to detect a torn write at the tail.
+func OpenStorage(storage Storage, size int64, opts ...SegFileOption) (SegFile, error) {
+	f := &segFile{storage: storage}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if err := f.scan(size); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// scan reads frame headers from the storage from the start, stopping
+// at the first torn write: a frame header that wasn't fully written,
+// or one whose declared payload runs past size. Anything after that
+// point is discarded, since a healthy replica is expected to fill it
+// back in via Repair.
+func (f *segFile) scan(size int64) error {
 	var a [frameHeaderSize]byte
 	var off int64
 	for {
-		buf := a[:]
-		n, err := f.file.ReadAt(buf, off)
-		if err != nil {
-			if err != io.EOF {
-				return nil, err
-			}
+		n, err := f.storage.ReadAt(a[:], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
 			break
 		}
-		if n != frameHeaderSize {
+		h, hdrSize, ok := unmarshalFrameHeader(a[:n])
+		if !ok {
 			break
 		}
-		var s frame
-		h := &frameHeader{}
-		h.unmarshal(buf)
-		s.frameHeader = *h
-		s.pos = uint64(off) + uint64(frameHeaderSize)
+		pos := off + int64(hdrSize)
+		if pos+int64(h.size) > size {
+			break
+		}
+		s := frame{frameHeader: h, pos: uint64(pos)}
 		f.frames = append(f.frames, s)
-		f.off += int64(frameHeaderSize) + int64(s.size)
-		off = int64(f.off)
+		f.off = pos + int64(h.size)
+		off = f.off
 	}
-	return f, nil
+	return nil
 }
 
 // WriteAt writes len(p) bytes from p to the underlying data stream
@@ -246,17 +765,43 @@ func OpenSegFile(name string) (SegFile, error) {
 // and any error encountered that caused the write to stop early.
 // WriteAt must return a non-nil error if it returns n < len(p).
 func (f *segFile) WriteAt(b []byte, off int64) (n int, err error) {
-	s := frame{frameHeader: frameHeader{off: uint64(off), size: uint64(len(b))}, pos: uint64(f.off + int64(frameHeaderSize))}
-	f.file.WriteAt(s.frameHeader.marshal(), int64(f.off))
-	n, err = f.file.WriteAt(b, int64(s.pos))
+	return f.WriteAtSeq(b, off, 0)
+}
+
+// WriteAtSeq is like WriteAt but stamps the frame with a caller-supplied
+// write sequence number, so Repair can later tell which of two
+// replicas holds the newer version of an overwritten range. A File
+// writing through more than one replica uses this to propagate the
+// same seq to every replica of a given logical write.
+func (f *segFile) WriteAtSeq(b []byte, off int64, seq uint64) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := frame{frameHeader: newFrameHeader(uint64(off), b, seq), pos: uint64(f.off + int64(frameHeaderSize))}
+	f.storage.WriteAt(s.frameHeader.marshal(), int64(f.off))
+	n, err = f.storage.WriteAt(b, int64(s.pos))
 	f.frames = append(f.frames, s)
 	f.off += int64(frameHeaderSize) + int64(s.size)
+	if f.autoCompact > 0 && f.off >= f.nextCompactCheck {
+		if stats := f.statsLocked(); stats.LiveBytes*2 < stats.TotalBytes {
+			f.compactLocked()
+		} else {
+			f.checkInterval *= 2
+			f.nextCompactCheck = f.off + f.checkInterval
+		}
+	}
 	return
 }
 
 // ReadAt reads frames starting at offset off in the
 // underlying input source. It returns the frames and any error encountered.
+//
+// A frame whose checksum doesn't match its payload is skipped and
+// reported via a *CorruptFrameError, so the caller can still use the
+// healthy frames gathered and fall back to another replica for the
+// gap.
 func (f *segFile) ReadAt(off, size int64) (frames []Frame, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	idx := sort.Search(len(f.frames), func(i int) bool {
 		return f.frames[i].off > uint64(off)
 	})
@@ -273,7 +818,15 @@ func (f *segFile) ReadAt(off, size int64) (frames []Frame, err error) {
 			break
 		}
 		b := make([]byte, s.size)
-		_, err = f.file.ReadAt(b, int64(s.pos))
+		if _, rerr := f.storage.ReadAt(b, int64(s.pos)); rerr != nil && rerr != io.EOF {
+			return frames, rerr
+		}
+		if !s.legacy && crc32.Checksum(b, crc32cTable) != s.checksum {
+			if err == nil {
+				err = &CorruptFrameError{Name: f.name(), Offset: int64(s.off)}
+			}
+			continue
+		}
 		var r = Frame{frameHeader: s.frameHeader}
 		r.data = b
 		frames = append(frames, r)
@@ -286,5 +839,158 @@ func (f *segFile) ReadAt(off, size int64) (frames []Frame, err error) {
 // be canceled and return immediately with an error.
 // Close will return an error if it has already been called.
 func (f *segFile) Close() error {
-	return f.file.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.storage.Close()
+}
+
+// Sync commits the segment's current contents to stable storage.
+func (f *segFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.storage.Sync()
+}
+
+// name returns the storage's name for diagnostics, falling back to a
+// generic label when the backend has none (e.g. in-memory or remote
+// storage). Unlocked: its only caller, ReadAt, already holds f.mu.
+func (f *segFile) name() string {
+	if n, ok := f.storage.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return "segment"
+}
+
+// Verify validates every recorded frame's payload against its stored
+// checksum and returns the offsets of any that are corrupt. Frames
+// written before checksums were introduced are assumed healthy, since
+// there is nothing to check them against.
+func (f *segFile) Verify() ([]int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var corrupt []int64
+	for _, s := range f.frames {
+		if s.legacy {
+			continue
+		}
+		b := make([]byte, s.size)
+		if _, err := f.storage.ReadAt(b, int64(s.pos)); err != nil && err != io.EOF {
+			return corrupt, err
+		}
+		if crc32.Checksum(b, crc32cTable) != s.checksum {
+			corrupt = append(corrupt, int64(s.off))
+		}
+	}
+	return corrupt, nil
+}
+
+// Stats reports the segment's live vs. total bytes, useful for
+// deciding when to Compact.
+func (f *segFile) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.statsLocked()
+}
+
+// statsLocked is Stats' core logic, for callers that already hold f.mu.
+func (f *segFile) statsLocked() Stats {
+	var live, total int64
+	for _, fr := range f.frames {
+		total += int64(fr.size)
+	}
+	for _, lr := range liveRanges(f.frames) {
+		live += int64(lr.size)
+	}
+	return Stats{LiveBytes: live, TotalBytes: total, FrameCount: len(f.frames)}
+}
+
+// Compact rewrites the segment into a new file holding only the live
+// byte ranges - the parts of each frame not shadowed by a later
+// overwrite - computed by walking frames newest-to-oldest, then
+// atomically renames it into place. It returns the segment's stats
+// after compaction. Compact requires a storage backend that can be
+// replaced by name, such as a local file; it returns an error for
+// backends like an in-memory buffer or a remote reader.
+func (f *segFile) Compact() (Stats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.compactLocked()
+}
+
+// compactLocked is Compact's core logic, for callers that already
+// hold f.mu - in particular WriteAtSeq's auto-compact check, which
+// cannot call Compact itself without deadlocking on the non-reentrant
+// mutex.
+func (f *segFile) compactLocked() (Stats, error) {
+	cs, ok := f.storage.(compactableStorage)
+	if !ok {
+		return Stats{}, fmt.Errorf("mergefs: storage %T does not support Compact", f.storage)
+	}
+	live := liveRanges(f.frames)
+	sort.Slice(live, func(i, j int) bool { return live[i].off < live[j].off })
+
+	tmpName := cs.Name() + ".compact"
+	tmpFile, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return Stats{}, err
+	}
+	nf := &segFile{storage: tmpFile}
+	for _, lr := range live {
+		s := f.frames[lr.frameIdx]
+		b := make([]byte, lr.size)
+		srcPos := int64(s.pos) + int64(lr.off-s.off)
+		if _, err := f.storage.ReadAt(b, srcPos); err != nil && err != io.EOF {
+			tmpFile.Close()
+			os.Remove(tmpName)
+			return Stats{}, err
+		}
+		if _, err := nf.WriteAtSeq(b, int64(lr.off), s.seq); err != nil {
+			tmpFile.Close()
+			os.Remove(tmpName)
+			return Stats{}, err
+		}
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpName)
+		return Stats{}, err
+	}
+	name := cs.Name()
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpName)
+		return Stats{}, err
+	}
+	if err := cs.Close(); err != nil {
+		os.Remove(tmpName)
+		return Stats{}, err
+	}
+	if err := os.Rename(tmpName, name); err != nil {
+		return Stats{}, err
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return Stats{}, err
+	}
+	f.storage = file
+	f.frames = nf.frames
+	f.off = nf.off
+	if f.autoCompact > 0 {
+		f.checkInterval = f.autoCompact
+		f.nextCompactCheck = f.off + f.checkInterval
+	}
+	return f.statsLocked(), nil
+}
+
+// Size returns the logical length of the segment, computed from the
+// highest offset covered by any recorded frame.
+func (f *segFile) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var size int64
+	for i := 0; i < len(f.frames); i++ {
+		if end := int64(f.frames[i].off + f.frames[i].size); end > size {
+			size = end
+		}
+	}
+	return size
 }
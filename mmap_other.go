@@ -0,0 +1,32 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package mergefs
+
+import "fmt"
+
+// MmapStorage is only implemented on unix platforms.
+type MmapStorage struct{}
+
+// NewMmapStorage returns an error: mmap-backed storage isn't
+// implemented on this platform.
+func NewMmapStorage(name string) (*MmapStorage, error) {
+	return nil, fmt.Errorf("mergefs: MmapStorage is not supported on this platform")
+}
+
+func (m *MmapStorage) ReadAt(b []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("mergefs: MmapStorage is not supported on this platform")
+}
+
+func (m *MmapStorage) WriteAt(b []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("mergefs: MmapStorage is not supported on this platform")
+}
+
+func (m *MmapStorage) Sync() error { return nil }
+
+func (m *MmapStorage) Close() error { return nil }
+
+// Size always returns 0 on platforms without mmap support.
+func (m *MmapStorage) Size() int64 { return 0 }
@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build unix
+
+package mergefs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// MmapStorage is a read-heavy Storage backend that memory-maps a
+// local file instead of issuing a ReadAt syscall per frame. It is
+// read-only: open the file normally with OpenSegFile for writes, then
+// map a fresh MmapStorage afterward to pick up the new bytes.
+type MmapStorage struct {
+	file *os.File
+	data []byte
+}
+
+// NewMmapStorage maps the named file read-only into memory.
+func NewMmapStorage(name string) (*MmapStorage, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return &MmapStorage{file: file}, nil
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &MmapStorage{file: file, data: data}, nil
+}
+
+// ReadAt implements io.ReaderAt directly against the mapped region.
+func (m *MmapStorage) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 || off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n = copy(b, m.data[off:])
+	if n < len(b) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt always returns an error: MmapStorage is read-only.
+func (m *MmapStorage) WriteAt(b []byte, off int64) (n int, err error) {
+	return 0, fmt.Errorf("mergefs: %s: MmapStorage is read-only", m.file.Name())
+}
+
+// Sync is a no-op: MmapStorage never writes.
+func (m *MmapStorage) Sync() error { return nil }
+
+// Close unmaps the region and closes the underlying file.
+func (m *MmapStorage) Close() error {
+	if m.data != nil {
+		if err := syscall.Munmap(m.data); err != nil {
+			return err
+		}
+	}
+	return m.file.Close()
+}
+
+// Size returns the mapped region's length, for use with OpenStorage.
+func (m *MmapStorage) Size() int64 {
+	return int64(len(m.data))
+}
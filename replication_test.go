@@ -0,0 +1,152 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestPolicyReplication(t *testing.T) {
+	name := "mergefs-replication"
+	{
+		RemoveN(name, 3)
+		defer RemoveN(name, 3)
+	}
+	f, err := OpenFileN(name, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WithPolicy(Policy{W: 3, R: 2})
+	defer f.Close()
+
+	content := []byte("quorum replicated frame")
+	if n, err := f.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	} else if n != len(content) {
+		t.Errorf("expect %d, got %d", len(content), n)
+	}
+
+	buf := make([]byte, len(content))
+	if n, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	} else if n != len(content) || string(buf) != string(content) {
+		t.Errorf("expect %q, got %q", content, buf[:n])
+	}
+}
+
+func TestRepair(t *testing.T) {
+	name := "mergefs-repair"
+	{
+		RemoveN(name, 2)
+		defer RemoveN(name, 2)
+	}
+	f, err := OpenFileN(name, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	content := []byte("healed by repair")
+	// Write directly to only the first replica, simulating a partial
+	// write that stopped short of the second.
+	if _, err := f.files[0].WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Repair(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := f.files[1].ReadAt(0, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || string(frames[0].data) != string(content) {
+		t.Errorf("expect replica 1 healed with %q, got %v", content, frames)
+	}
+}
+
+// TestRepairPrefersNewestVersion guards against Repair deduplicating an
+// (offset, size) range by presence alone: if both replicas already
+// have a frame for the range, the older one must not be left in place
+// just because it's present.
+func TestRepairPrefersNewestVersion(t *testing.T) {
+	name := "mergefs-repair-newest"
+	{
+		RemoveN(name, 2)
+		defer RemoveN(name, 2)
+	}
+	f, err := OpenFileN(name, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	v1 := []byte("version one......")
+	v2 := []byte("version two......")
+	for _, sf := range f.files {
+		if _, err := sf.(SeqWriter).WriteAtSeq(v1, 0, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only replica 0 sees the overwrite, simulating a partial write
+	// that stopped short of replica 1.
+	if _, err := f.files[0].(SeqWriter).WriteAtSeq(v2, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Repair(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := f.files[1].ReadAt(0, int64(len(v2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || string(frames[0].data) != string(v2) {
+		t.Errorf("expect replica 1 healed with newest version %q, got %v", v2, frames)
+	}
+}
+
+// TestConcurrentWriteAndRepair exercises a File's replicas under the
+// same concurrent access pattern production traffic produces - WriteAt
+// fanning out to every replica at once alongside a background
+// ReadRepair - so that a data race in segFile's frame index shows up
+// under go test -race.
+func TestConcurrentWriteAndRepair(t *testing.T) {
+	name := "mergefs-concurrent"
+	{
+		RemoveN(name, 2)
+		defer RemoveN(name, 2)
+	}
+	f, err := OpenFileN(name, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WithPolicy(Policy{W: 1, R: 1, ReadRepair: true})
+	defer f.Close()
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := []byte{byte(i)}
+			if _, err := f.WriteAt(content, int64(i)); err != nil {
+				t.Error(err)
+				return
+			}
+			buf := make([]byte, 1)
+			if _, err := f.ReadAt(buf, int64(i)); err != nil && err != io.EOF {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := f.Repair(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// MemStorage is an in-memory Storage backend, useful for tests that
+// want a segFile without touching disk.
+type MemStorage struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// NewMemStorage returns an empty in-memory Storage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{}
+}
+
+// ReadAt implements io.ReaderAt.
+func (m *MemStorage) ReadAt(b []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n = copy(b, m.data[off:])
+	if n < len(b) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt, growing the buffer as needed.
+func (m *MemStorage) WriteAt(b []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	end := off + int64(len(b))
+	if end > int64(len(m.data)) {
+		grown := make([]byte, end)
+		copy(grown, m.data)
+		m.data = grown
+	}
+	return copy(m.data[off:], b), nil
+}
+
+// Sync is a no-op: the buffer never leaves memory.
+func (m *MemStorage) Sync() error { return nil }
+
+// Close is a no-op.
+func (m *MemStorage) Close() error { return nil }
+
+// Size returns the current length of the backing buffer, for use with
+// OpenStorage.
+func (m *MemStorage) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.data))
+}
+
+// HTTPStorage is a read-only Storage backend that serves ReadAt
+// requests as HTTP Range requests against a URL, similar in spirit to
+// slicing a local file with io.NewSectionReader. It lets a *File span
+// local and remote segments without downloading everything up front.
+type HTTPStorage struct {
+	client *http.Client
+	url    string
+}
+
+// NewHTTPStorage returns a Storage that reads url via HTTP Range
+// requests using client. A nil client uses http.DefaultClient.
+func NewHTTPStorage(client *http.Client, url string) *HTTPStorage {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPStorage{client: client, url: url}
+}
+
+// ReadAt implements io.ReaderAt by issuing a ranged GET request for
+// the len(b) bytes starting at off.
+func (h *HTTPStorage) ReadAt(b []byte, off int64) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(b))-1))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the Range header and sent the whole object.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return 0, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// off is at or past the end of the object.
+		return 0, io.EOF
+	default:
+		return 0, fmt.Errorf("mergefs: %s: unexpected status %s", h.url, resp.Status)
+	}
+	n, err = io.ReadFull(resp.Body, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt always returns an error: HTTPStorage is read-only.
+func (h *HTTPStorage) WriteAt(b []byte, off int64) (n int, err error) {
+	return 0, fmt.Errorf("mergefs: %s: HTTPStorage is read-only", h.url)
+}
+
+// Sync is a no-op: HTTPStorage never buffers writes.
+func (h *HTTPStorage) Sync() error { return nil }
+
+// Close is a no-op.
+func (h *HTTPStorage) Close() error { return nil }
+
+// Size issues a HEAD request to discover the remote object's length,
+// for use with OpenStorage.
+func (h *HTTPStorage) Size() (int64, error) {
+	resp, err := h.client.Head(h.url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("mergefs: %s: unexpected status %s", h.url, resp.Status)
+	}
+	return resp.ContentLength, nil
+}
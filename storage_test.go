@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"testing"
+)
+
+func TestOpenStorage(t *testing.T) {
+	storage := NewMemStorage()
+	sf, err := OpenStorage(storage, storage.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+
+	content := []byte("in-memory segment")
+	if n, err := sf.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	} else if n != len(content) {
+		t.Errorf("expect %d, got %d", len(content), n)
+	}
+
+	frames, err := sf.ReadAt(0, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || string(frames[0].data) != string(content) {
+		t.Errorf("expect %q, got %v", content, frames)
+	}
+
+	// Reopening against the same backing buffer should recover the
+	// frame from its header, exactly like reopening a local file.
+	reopened, err := OpenStorage(storage, storage.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	frames, err = reopened.ReadAt(0, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || string(frames[0].data) != string(content) {
+		t.Errorf("expect %q after reopen, got %v", content, frames)
+	}
+}
+
+func TestStorageNotCompactable(t *testing.T) {
+	sf, err := OpenStorage(NewMemStorage(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+	if _, err := sf.Compact(); err == nil {
+		t.Error("expect Compact on MemStorage to fail, got nil error")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"fmt"
+	"io"
+)
+
+// defaultPrefetch is how far ahead Reader reads on a cache miss, so a
+// run of small sequential reads pays the ReadAt/merge cost once
+// instead of once per call.
+const defaultPrefetch = 64 * 1024
+
+// Reader is an io.ReadSeekCloser over a *File that maintains its own
+// cursor and prefetches adjacent frames on sequential reads.
+type Reader struct {
+	f      *File
+	off    int64
+	buf    []byte
+	bufOff int64
+}
+
+// NewReader returns a Reader over f starting at offset 0. Closing the
+// Reader does not close f.
+func NewReader(f *File) io.ReadSeekCloser {
+	return &Reader{f: f}
+}
+
+func (r *Reader) fill(want int) error {
+	if want < defaultPrefetch {
+		want = defaultPrefetch
+	}
+	buf := make([]byte, want)
+	n, err := r.f.ReadAt(buf, r.off)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	r.buf = buf[:n]
+	r.bufOff = r.off
+	return nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if r.buf == nil || r.off < r.bufOff || r.off >= r.bufOff+int64(len(r.buf)) {
+		if err := r.fill(len(b)); err != nil {
+			return 0, err
+		}
+		if len(r.buf) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, r.buf[r.off-r.bufOff:])
+	r.off += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		r.off = offset
+	case io.SeekCurrent:
+		r.off += offset
+	case io.SeekEnd:
+		r.off = r.f.Size() + offset
+	default:
+		return 0, fmt.Errorf("mergefs: Reader.Seek: invalid whence %d", whence)
+	}
+	if r.off < 0 {
+		return 0, fmt.Errorf("mergefs: Reader.Seek: negative position")
+	}
+	r.buf = nil
+	return r.off, nil
+}
+
+// Close implements io.Closer. It does not close the underlying File.
+func (r *Reader) Close() error {
+	return nil
+}
+
+// defaultCoalesce is how many buffered bytes Writer accumulates before
+// flushing them as a single frame.
+const defaultCoalesce = 64 * 1024
+
+// Writer is an io.WriteCloser over a *File that maintains its own
+// cursor and coalesces small sequential writes into larger frames
+// before flushing, reducing header overhead and improving
+// mergeFrames locality on later reads.
+type Writer struct {
+	f      *File
+	off    int64
+	buf    []byte
+	bufOff int64
+}
+
+// NewWriter returns a Writer over f starting at offset 0. Buffered
+// bytes reach f only once the buffer fills or on Flush or Close; the
+// returned io.WriteCloser exposes Close, which flushes without closing
+// f.
+func NewWriter(f *File) io.WriteCloser {
+	return &Writer{f: f}
+}
+
+// Write implements io.Writer, buffering b until it grows past
+// defaultCoalesce or the write stream stops being sequential.
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.buf == nil {
+		w.bufOff = w.off
+	} else if w.bufOff+int64(len(w.buf)) != w.off {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+		w.bufOff = w.off
+	}
+	w.buf = append(w.buf, b...)
+	w.off += int64(len(b))
+	if len(w.buf) >= defaultCoalesce {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes any buffered bytes out as a single frame.
+func (w *Writer) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.f.WriteAt(w.buf, w.bufOff)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Close flushes any buffered bytes. It does not close the underlying
+// File.
+func (w *Writer) Close() error {
+	return w.Flush()
+}
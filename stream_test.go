@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package mergefs
+
+import (
+	"io"
+	"testing"
+)
+
+func TestReaderWriter(t *testing.T) {
+	name := "mergefs-stream"
+	Remove(name)
+	defer Remove(name)
+
+	f, err := OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	content := make([]byte, defaultCoalesce*2+37)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	w := NewWriter(f)
+	for off := 0; off < len(content); off += 17 {
+		end := off + 17
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err := w.Write(content[off:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := f.Size(); got != int64(len(content)) {
+		t.Errorf("expect size %d, got %d", len(content), got)
+	}
+
+	r := NewReader(f)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("expect %d bytes round-tripped, got %d mismatching", len(content), len(got))
+	}
+
+	if _, err := r.Seek(int64(len(content))-5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tail := make([]byte, 5)
+	if _, err := io.ReadFull(r, tail); err != nil {
+		t.Fatal(err)
+	}
+	if string(tail) != string(content[len(content)-5:]) {
+		t.Errorf("expect tail %v, got %v", content[len(content)-5:], tail)
+	}
+}